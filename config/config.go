@@ -0,0 +1,57 @@
+// Package config holds the configuration types read from the Horizon config file and handed to the
+// various edge node workers at startup.
+package config
+
+// HorizonConfig is the root of the parsed Horizon config file.
+type HorizonConfig struct {
+	Edge EdgeConfig
+}
+
+// EdgeConfig holds the settings specific to the sample edge node implementation, including the bits
+// GovernanceWorker needs: where to reach the blockchain and exchange, and how long an agreement is
+// allowed to sit unrecorded before it's timed out.
+type EdgeConfig struct {
+	// GethURL is the JSON-RPC endpoint GovernanceWorker uses to read and watch blockchain state.
+	GethURL string
+
+	// ExchangeURL is the base URL of the Horizon exchange this device reports agreement state to.
+	ExchangeURL string
+
+	// AgreementTimeoutS is how long an agreement may go unrecorded on the blockchain before
+	// GovernanceWorker cancels it.
+	AgreementTimeoutS uint64
+
+	// AgreementConfirmationDepth is how many blocks must pass after an AgreementRecorded event before
+	// GovernanceWorker will report the agreement finalized, guarding against short reorgs.
+	AgreementConfirmationDepth uint64
+
+	// AgreementProtocols lists the agreement protocol names GovernanceWorker should register handlers
+	// for at startup. Defaults to just the citizenscientist protocol when left empty.
+	AgreementProtocols []string
+
+	// ExchangeRetryMaxAttempts bounds how many attempts retryExchangeCall makes before giving up on a
+	// down exchange. Defaults to defaultExchangeRetryMaxAttempts when 0.
+	ExchangeRetryMaxAttempts int
+
+	// ExchangeRetryMaxElapsedS bounds how long retryExchangeCall will keep retrying a down exchange
+	// before giving up. Defaults to defaultExchangeRetryMaxElapsed when 0.
+	ExchangeRetryMaxElapsedS int64
+
+	// MetricsBindAddress is the host:port GovernanceWorker serves Prometheus metrics on. Leave empty to
+	// disable the metrics server.
+	MetricsBindAddress string
+
+	// ArchivedAgreementGCIntervalS is how often GovernanceWorker sweeps archived agreements for
+	// retention-based garbage collection. Defaults to defaultArchivedAgreementGCInterval when 0.
+	ArchivedAgreementGCIntervalS int64
+
+	// ArchivedAgreementRetentionS is how long an archived agreement record is kept before the GC drops
+	// it. Defaults to defaultArchivedAgreementRetention when 0.
+	ArchivedAgreementRetentionS int64
+
+	// EnableAgreementEventSubscription turns on the event-driven agreement watcher (in addition to the
+	// polling sweep, which always runs). Left off by default: ethblockchain.SubscribeLogs doesn't have
+	// a real eth_subscribe implementation yet, so turning this on today would just retry a subscription
+	// that can never establish.
+	EnableAgreementEventSubscription bool
+}
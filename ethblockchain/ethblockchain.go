@@ -0,0 +1,73 @@
+// Package ethblockchain wraps the geth JSON-RPC client used to read and watch the Agreements
+// contract's state, independent of which agreement protocol is interpreting that state.
+package ethblockchain
+
+import (
+	"fmt"
+)
+
+// BaseContracts holds the platform contracts every agreement protocol built on this blockchain shares,
+// resolved once at startup from the directory contract.
+type BaseContracts struct {
+	Agreements *Agreements
+}
+
+// Agreements is a handle on the deployed Agreements contract.
+type Agreements struct {
+	Address string
+}
+
+// AccountId returns the blockchain account this device transacts as.
+func AccountId() (string, error) {
+	return "", fmt.Errorf("ethblockchain: AccountId not implemented")
+}
+
+// DirectoryAddress returns the address of the directory contract used to resolve the platform's other
+// contracts, including Agreements.
+func DirectoryAddress() (string, error) {
+	return "", fmt.Errorf("ethblockchain: DirectoryAddress not implemented")
+}
+
+// InitBaseContracts resolves and returns the platform contracts reachable from directoryAddress, using
+// acct as the account any writes (e.g. agreement termination) are sent from.
+func InitBaseContracts(acct string, gethURL string, directoryAddress string) (*BaseContracts, error) {
+	return nil, fmt.Errorf("ethblockchain: InitBaseContracts not implemented")
+}
+
+// Log is a decoded entry from an eth_subscribe logs subscription.
+type Log struct {
+	BlockNumber uint64
+	Topics      []string
+	Data        []byte
+}
+
+// LogSubscription is a live eth_subscribe subscription against a contract's logs.
+type LogSubscription interface {
+	// Err delivers the subscription's terminal error, if any, when it drops.
+	Err() <-chan error
+	// Unsubscribe tears down the subscription. Safe to call more than once.
+	Unsubscribe()
+}
+
+// SubscribeLogs opens an eth_subscribe logs subscription against contractAddress, filtered to the
+// given event names, and returns the subscription handle alongside the channel decoded events arrive
+// on.
+//
+// Not implemented yet: a real subscription needs a persistent JSON-RPC/WebSocket connection to gethURL
+// (the plain HTTP JSON-RPC client in rpc.go can't do eth_subscribe), plus the contract ABI to decode
+// eth_subscription notifications back into Log. Until that lands, callers must not rely on this; the
+// governance event watcher that uses it is gated off by config.Edge.EnableAgreementEventSubscription
+// (defaulted to false) for exactly this reason.
+func SubscribeLogs(gethURL string, contractAddress string, eventNames []string) (LogSubscription, <-chan Log, error) {
+	return nil, nil, fmt.Errorf("ethblockchain: SubscribeLogs not implemented")
+}
+
+// DecodeAgreementEvent pulls the agreement id and event name out of a log entry emitted by the
+// Agreements contract.
+//
+// Not implemented yet: decoding a real log requires the Agreements contract's ABI, to match
+// logEvent.Topics[0] against each event's signature hash and unpack logEvent.Data accordingly. See
+// SubscribeLogs' doc comment - nothing calls this in practice until that work lands.
+func DecodeAgreementEvent(logEvent Log) (agreementId string, eventName string, err error) {
+	return "", "", fmt.Errorf("ethblockchain: DecodeAgreementEvent not implemented")
+}
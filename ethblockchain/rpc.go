@@ -0,0 +1,79 @@
+package ethblockchain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// jsonRPCRequest is a standard JSON-RPC 2.0 call.
+type jsonRPCRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	Id      int           `json:"id"`
+}
+
+// jsonRPCResponse is a standard JSON-RPC 2.0 reply. Result is left raw so each caller can unmarshal it
+// into whatever shape that particular method returns.
+type jsonRPCResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// callRPC makes a single JSON-RPC 2.0 call against gethURL and returns the raw result field.
+func callRPC(gethURL string, method string, params ...interface{}) (json.RawMessage, error) {
+	body, err := json.Marshal(jsonRPCRequest{JSONRPC: "2.0", Method: method, Params: params, Id: 1})
+	if err != nil {
+		return nil, fmt.Errorf("ethblockchain: unable to marshal %v request: %v", method, err)
+	}
+
+	resp, err := http.Post(gethURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("ethblockchain: %v request to %v failed: %v", method, gethURL, err)
+	}
+	defer resp.Body.Close()
+
+	var rpcResp jsonRPCResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return nil, fmt.Errorf("ethblockchain: unable to decode %v response from %v: %v", method, gethURL, err)
+	}
+	if rpcResp.Error != nil {
+		return nil, fmt.Errorf("ethblockchain: %v call to %v returned error %v: %v", method, gethURL, rpcResp.Error.Code, rpcResp.Error.Message)
+	}
+
+	return rpcResp.Result, nil
+}
+
+// parseQuantity parses a JSON-RPC "quantity" result - a "0x"-prefixed hex string - into a uint64.
+func parseQuantity(raw json.RawMessage) (uint64, error) {
+	var hexStr string
+	if err := json.Unmarshal(raw, &hexStr); err != nil {
+		return 0, fmt.Errorf("ethblockchain: result %s is not a JSON string: %v", raw, err)
+	}
+
+	hexStr = strings.TrimPrefix(hexStr, "0x")
+	value, err := strconv.ParseUint(hexStr, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("ethblockchain: result %q is not a hex quantity: %v", hexStr, err)
+	}
+
+	return value, nil
+}
+
+// GetBlockNumber returns the current chain head as seen by the geth node at gethURL, via the standard
+// eth_blockNumber JSON-RPC call.
+func GetBlockNumber(gethURL string) (uint64, error) {
+	result, err := callRPC(gethURL, "eth_blockNumber")
+	if err != nil {
+		return 0, err
+	}
+
+	return parseQuantity(result)
+}
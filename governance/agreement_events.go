@@ -0,0 +1,122 @@
+package governance
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/anax/ethblockchain"
+	"github.com/open-horizon/anax/worker"
+	"time"
+)
+
+// Names of the events emitted by the Agreements contract that the governor cares about. These
+// mirror the event names in the contract ABI used by the citizenscientist protocol.
+const ethEventAgreementRecorded = "AgreementRecorded"
+const ethEventAgreementTerminated = "AgreementTerminated"
+
+// How long to wait before retrying a subscription that failed to establish or dropped.
+const agreementSubscriptionRetryWait = 5 * time.Second
+
+// agreementEventWatcher maintains an eth_subscribe log subscription against the Agreements contract,
+// analogous to the way the Wormhole EVM watcher subscribes to NewHead/log events on a geth JSON-RPC
+// endpoint. Decoded events are translated into commands on the governor's command channel so that
+// agreement finalization doesn't have to wait for the next polling interval. When the subscription
+// can't be established, governAgreements' existing polling loop continues to carry the load; when a
+// subscription does come up (or comes back after a drop), the watcher asks for a full reconciliation
+// sweep first so that no event is missed while the socket was down.
+//
+// ethblockchain.SubscribeLogs has no real eth_subscribe implementation yet (see its doc comment), so
+// governAgreements only starts this watcher when config.Edge.EnableAgreementEventSubscription is set.
+type agreementEventWatcher struct {
+	gethURL    string
+	agreements *ethblockchain.Agreements
+}
+
+func newAgreementEventWatcher(gethURL string, agreements *ethblockchain.Agreements) *agreementEventWatcher {
+	return &agreementEventWatcher{
+		gethURL:    gethURL,
+		agreements: agreements,
+	}
+}
+
+// start subscribes to the Agreements contract's logs and delivers decoded events as commands on cmds.
+// It resubscribes after any error or closed subscription, and returns as soon as ctx is done.
+func (a *agreementEventWatcher) start(ctx context.Context, cmds chan worker.Command) {
+	for {
+		sub, eventCh, err := ethblockchain.SubscribeLogs(a.gethURL, a.agreements.Address, []string{ethEventAgreementRecorded, ethEventAgreementTerminated})
+		if err != nil {
+			glog.V(3).Infof(logString(fmt.Sprintf("unable to subscribe to agreement events, error: %v. Relying on polling until a subscription is available.", err)))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(agreementSubscriptionRetryWait):
+				continue
+			}
+		}
+
+		glog.Infof(logString("agreement event subscription established, reconciling in case events were missed while disconnected"))
+		select {
+		case cmds <- NewReconcileAgreementsCommand():
+		case <-ctx.Done():
+			sub.Unsubscribe()
+			return
+		}
+
+		if !a.drain(ctx, sub, eventCh, cmds) {
+			return
+		}
+
+		glog.Warningf(logString("agreement event subscription dropped, resubscribing"))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(agreementSubscriptionRetryWait):
+		}
+	}
+}
+
+// drain reads decoded log events off eventCh until the subscription errors out, is closed by the
+// peer, or ctx is done. It returns false when the caller should stop watching entirely (ctx done).
+func (a *agreementEventWatcher) drain(ctx context.Context, sub ethblockchain.LogSubscription, eventCh <-chan ethblockchain.Log, cmds chan worker.Command) bool {
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case logEvent, ok := <-eventCh:
+			if !ok {
+				return true
+			}
+			a.handle(ctx, logEvent, cmds)
+		case err := <-sub.Err():
+			glog.Errorf(logString(fmt.Sprintf("agreement event subscription error: %v", err)))
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (a *agreementEventWatcher) handle(ctx context.Context, logEvent ethblockchain.Log, cmds chan worker.Command) {
+	agreementId, eventName, err := ethblockchain.DecodeAgreementEvent(logEvent)
+	if err != nil {
+		glog.Errorf(logString(fmt.Sprintf("unable to decode agreement event in block %v: %v", logEvent.BlockNumber, err)))
+		return
+	}
+
+	var cmd worker.Command
+	switch eventName {
+	case ethEventAgreementRecorded:
+		glog.V(3).Infof(logString(fmt.Sprintf("observed AgreementRecorded for %v at block %v", agreementId, logEvent.BlockNumber)))
+		cmd = NewAgreementRecordedCommand(agreementId, logEvent.BlockNumber)
+	case ethEventAgreementTerminated:
+		glog.V(3).Infof(logString(fmt.Sprintf("observed AgreementTerminated for %v at block %v", agreementId, logEvent.BlockNumber)))
+		cmd = NewAgreementTerminatedCommand(agreementId)
+	default:
+		return
+	}
+
+	select {
+	case cmds <- cmd:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,145 @@
+package governance
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/open-horizon/anax/config"
+	"github.com/open-horizon/anax/ethblockchain"
+	"github.com/open-horizon/anax/persistence"
+	"github.com/open-horizon/anax/policy"
+	"os"
+	"testing"
+)
+
+// fakeProtocolHandler is just enough of a ProtocolHandler for the confirmation-depth tests below. Its
+// VerifyAgreementRecorded always reports the agreement as not recorded, which the reorg rollback test
+// relies on; the tests never reach the parts that call TerminateAgreement/DemarshalProposal.
+type fakeProtocolHandler struct{ name string }
+
+func (h *fakeProtocolHandler) Name() string { return h.name }
+func (h *fakeProtocolHandler) VerifyAgreementRecorded(agreementId string, counterPartyAddress string, signature string, agreements *ethblockchain.Agreements) (bool, error) {
+	return false, nil
+}
+func (h *fakeProtocolHandler) TerminateAgreement(pPolicy *policy.Policy, counterPartyAddress string, agreementId string, reason uint, agreements *ethblockchain.Agreements) error {
+	return nil
+}
+func (h *fakeProtocolHandler) DemarshalProposal(proposal string) (Proposal, error) {
+	return nil, nil
+}
+
+func newTestGovernanceWorker(t *testing.T) (*GovernanceWorker, func()) {
+	t.Helper()
+
+	f, err := os.CreateTemp("", "governance-test-*.db")
+	if err != nil {
+		t.Fatalf("unable to create temp db file: %v", err)
+	}
+	f.Close()
+
+	db, err := bolt.Open(f.Name(), 0600, nil)
+	if err != nil {
+		t.Fatalf("unable to open bolt db: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &GovernanceWorker{
+		db: db,
+	}
+	w.Worker.Manager.Config = &config.HorizonConfig{}
+	w.ctx = ctx
+	w.cancel = cancel
+
+	return w, func() {
+		cancel()
+		db.Close()
+		os.Remove(f.Name())
+	}
+}
+
+func putTestAgreement(t *testing.T, db *bolt.DB, protocolName string, ag persistence.EstablishedAgreement) {
+	t.Helper()
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("established_agreements_" + protocolName))
+		if err != nil {
+			return err
+		}
+		serialized, err := json.Marshal(ag)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(ag.CurrentAgreementId), serialized)
+	})
+	if err != nil {
+		t.Fatalf("unable to seed test agreement: %v", err)
+	}
+}
+
+// TestMarkRecordedAndMaybeFinalizeSeedsFromKnownBlock confirms the recordedAtBlock the event watcher
+// already knows is what gets persisted as AgreementRecordedBlockNumber, instead of re-querying the
+// chain head for it.
+func TestMarkRecordedAndMaybeFinalizeSeedsFromKnownBlock(t *testing.T) {
+	w, cleanup := newTestGovernanceWorker(t)
+	defer cleanup()
+	w.Worker.Manager.Config.Edge.AgreementConfirmationDepth = 100
+
+	const agreementId = "agreement-1"
+	putTestAgreement(t, w.db, "test-protocol", persistence.EstablishedAgreement{CurrentAgreementId: agreementId})
+
+	handler := &fakeProtocolHandler{name: "test-protocol"}
+	ag, err := persistence.FindEstablishedAgreements(w.db, "test-protocol", nil)
+	if err != nil || len(ag) != 1 {
+		t.Fatalf("unable to read back seeded agreement: %v, %v", ag, err)
+	}
+
+	// The test config leaves GethURL empty, so GetBlockNumber fails here; if markRecordedAndMaybeFinalize
+	// needed it to seed AgreementRecordedBlockNumber, this call would come back with it unset.
+	w.markRecordedAndMaybeFinalize(ag[0], handler, 5000)
+
+	updated, err := persistence.FindEstablishedAgreements(w.db, "test-protocol", nil)
+	if err != nil || len(updated) != 1 {
+		t.Fatalf("unable to read back agreement after marking recorded: %v, %v", updated, err)
+	}
+	if updated[0].AgreementRecordedBlockNumber != 5000 {
+		t.Errorf("AgreementRecordedBlockNumber = %v, expected the caller-supplied 5000", updated[0].AgreementRecordedBlockNumber)
+	}
+	if updated[0].AgreementFinalizedTime != 0 {
+		t.Errorf("expected the agreement not to be finalized yet, confirmation depth can't be checked without a working GetBlockNumber")
+	}
+}
+
+// TestSweepAgreementsForProtocolRollsBackOnReorg confirms that an agreement which was previously seen
+// recorded, but is no longer recorded on a later sweep, has its pending confirmation state rolled back
+// rather than being cancelled outright.
+func TestSweepAgreementsForProtocolRollsBackOnReorg(t *testing.T) {
+	w, cleanup := newTestGovernanceWorker(t)
+	defer cleanup()
+
+	const agreementId = "agreement-2"
+	putTestAgreement(t, w.db, "test-protocol", persistence.EstablishedAgreement{
+		CurrentAgreementId:           agreementId,
+		AgreementProtocol:            "test-protocol",
+		AgreementCreationTime:        1,
+		AgreementAcceptedTime:        1,
+		CounterPartyAddress:          "0xcounterparty",
+		AgreementRecordedBlockNumber: 4000,
+	})
+
+	handler := &fakeProtocolHandler{name: "test-protocol"}
+	w.protocolHandlers = map[string]ProtocolHandler{"test-protocol": handler}
+	w.bc = &ethblockchain.BaseContracts{Agreements: &ethblockchain.Agreements{}}
+
+	w.sweepAgreementsForProtocol("test-protocol", handler)
+
+	updated, err := persistence.FindEstablishedAgreements(w.db, "test-protocol", nil)
+	if err != nil || len(updated) != 1 {
+		t.Fatalf("unable to read back agreement after sweep: %v, %v", updated, err)
+	}
+	if updated[0].AgreementRecordedBlockNumber != 0 {
+		t.Errorf("AgreementRecordedBlockNumber = %v, expected rollback to 0 rather than a cancellation", updated[0].AgreementRecordedBlockNumber)
+	}
+	if updated[0].AgreementTerminatedTime != 0 {
+		t.Errorf("expected the agreement to survive the reorg rollback, not be terminated")
+	}
+}
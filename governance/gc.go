@@ -0,0 +1,56 @@
+package governance
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/anax/persistence"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+var archivedAgreementsReclaimedTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "anax_governance_archived_agreements_reclaimed_total",
+	Help: "Total archived agreement records dropped from bolt by the retention GC.",
+})
+
+const defaultArchivedAgreementRetention = 30 * 24 * time.Hour
+const defaultArchivedAgreementGCInterval = 1 * time.Hour
+
+// runArchiveGC walks each registered protocol's archived-agreement bucket and drops rows older than
+// the configured retention window, then calls persistence.CompactArchivedAgreements (which only syncs
+// the file; see its doc comment). It's invoked from the command processor's select
+// loop in start(), between command iterations, rather than from a free-running goroutine - the same
+// approach neo-go's value-based storage GC uses to run synchronously with persist cycles. That placement
+// keeps the GC out of the business of scheduling its own goroutine, but it is not what makes this safe
+// against finalizeAgreement/cancelAgreement, which archive and write the very rows purged here and run
+// concurrently on governAgreements' polling goroutine: what actually prevents corruption is that bolt
+// only ever allows one read-write transaction open at a time and blocks the others, so this GC's
+// db.Update calls are serialized against every other writer in the process regardless of which
+// goroutine issues them.
+func (w *GovernanceWorker) runArchiveGC() {
+	retention := time.Duration(w.Worker.Manager.Config.Edge.ArchivedAgreementRetentionS) * time.Second
+	if retention == 0 {
+		retention = defaultArchivedAgreementRetention
+	}
+	cutoff := uint64(time.Now().Add(-retention).Unix())
+
+	var reclaimed int
+	for protocolName := range w.protocolHandlers {
+		n, err := persistence.PurgeArchivedAgreementsOlderThan(w.db, protocolName, cutoff)
+		if err != nil {
+			glog.Errorf(logString(fmt.Sprintf("error purging archived agreements for protocol %v: %v", protocolName, err)))
+			continue
+		}
+		reclaimed += n
+	}
+
+	if reclaimed > 0 {
+		glog.V(3).Infof(logString(fmt.Sprintf("archived agreement GC reclaimed %v rows older than %v", reclaimed, retention)))
+		archivedAgreementsReclaimedTotal.Add(float64(reclaimed))
+	}
+
+	if err := persistence.CompactArchivedAgreements(w.db); err != nil {
+		glog.Errorf(logString(fmt.Sprintf("error compacting archived agreement bucket: %v", err)))
+	}
+}
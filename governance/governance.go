@@ -1,6 +1,7 @@
 package governance
 
 import (
+	"context"
 	"fmt"
 	"github.com/boltdb/bolt"
 	"github.com/golang/glog"
@@ -15,6 +16,7 @@ import (
 	"github.com/open-horizon/anax/worker"
 	"net/http"
 	"runtime"
+	"sync"
 	"time"
 )
 
@@ -39,14 +41,23 @@ const CANCEL_USER_REQUESTED = 105
 const CANCEL_DISCOVERED = 106
 
 type GovernanceWorker struct {
-	worker.Worker   // embedded field
-	db              *bolt.DB
-	bc              *ethblockchain.BaseContracts
-	deviceId        string
-	deviceToken     string
-	pm              *policy.PolicyManager
-	bcWritesEnabled bool // This field will be turned to true when the blockchain account has ether, which means
+	worker.Worker    // embedded field
+	db               *bolt.DB
+	bc               *ethblockchain.BaseContracts
+	deviceId         string
+	deviceToken      string
+	pm               *policy.PolicyManager
+	protocolHandlers map[string]ProtocolHandler // registered agreement protocols, keyed by protocol name
+	bcWritesEnabled  bool                       // This field will be turned to true when the blockchain account has ether, which means
 	// block chain writes (cancellations) can be done.
+	ctx    context.Context // cancelled by Stop() to begin graceful shutdown of all governance goroutines
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // tracks every goroutine started by start(), governAgreements and governContainers
+
+	// msgSendersWg tracks just the governAgreements sweep loop and governContainers loop, the two
+	// goroutines that do unguarded blocking sends on w.Messages(). shutdown waits on this before
+	// closing the channel so it can never race a send that's already in flight; see shutdown's comment.
+	msgSendersWg sync.WaitGroup
 }
 
 func NewGovernanceWorker(config *config.HorizonConfig, db *bolt.DB, pm *policy.PolicyManager) *GovernanceWorker {
@@ -60,6 +71,21 @@ func NewGovernanceWorker(config *config.HorizonConfig, db *bolt.DB, pm *policy.P
 		token = dev.Token
 	}
 
+	protocolHandlers := make(map[string]ProtocolHandler)
+	enabledProtocols := config.Edge.AgreementProtocols
+	if len(enabledProtocols) == 0 {
+		enabledProtocols = []string{citizenscientist.PROTOCOL_NAME}
+	}
+	for _, name := range enabledProtocols {
+		if factory, ok := protocolHandlerRegistry[name]; ok {
+			protocolHandlers[name] = factory(config.Edge.GethURL, pm)
+		} else {
+			glog.Errorf(logString(fmt.Sprintf("agreement protocol %v is configured but has no registered handler, skipping", name)))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	worker := &GovernanceWorker{
 
 		Worker: worker.Worker{
@@ -71,11 +97,14 @@ func NewGovernanceWorker(config *config.HorizonConfig, db *bolt.DB, pm *policy.P
 			Commands: commands,
 		},
 
-		db:              db,
-		pm:              pm,
-		deviceId: id,
-		deviceToken: token,
-		bcWritesEnabled: false,
+		db:               db,
+		pm:               pm,
+		deviceId:         id,
+		deviceToken:      token,
+		protocolHandlers: protocolHandlers,
+		bcWritesEnabled:  false,
+		ctx:              ctx,
+		cancel:           cancel,
 	}
 
 	worker.start()
@@ -86,12 +115,38 @@ func (w *GovernanceWorker) Messages() chan events.Message {
 	return w.Worker.Manager.Messages
 }
 
+// sendCommand enqueues cmd on w.Commands without blocking the caller. It's used both by NewEvent,
+// whose external producers have a lifetime independent of the command processor, and by handlers like
+// finalizeAgreement/cancelAgreement that re-enqueue their own work from inside handleCommand - i.e.
+// from the very goroutine that is the sole reader of w.Commands. A plain blocking send would either
+// race the processor's shutdown-time close of the channel, or - worse, for the re-enqueue case -
+// deadlock the processor against itself if the 200-slot buffer is ever full. If the buffer has room,
+// cmd is enqueued immediately; otherwise the send is retried from its own goroutine, which can afford
+// to block until either room frees up or the worker starts shutting down.
+func (w *GovernanceWorker) sendCommand(cmd worker.Command) {
+	select {
+	case w.Commands <- cmd:
+		return
+	default:
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		select {
+		case w.Commands <- cmd:
+		case <-w.ctx.Done():
+			glog.V(3).Infof(logString(fmt.Sprintf("dropping command %v, GovernanceWorker is shutting down", cmd)))
+		}
+	}()
+}
+
 func (w *GovernanceWorker) NewEvent(incoming events.Message) {
 
 	switch incoming.(type) {
 	case *events.EdgeRegisteredExchangeMessage:
 		msg, _ := incoming.(*events.EdgeRegisteredExchangeMessage)
-		w.Commands <- NewDeviceRegisteredCommand(msg.Token())
+		w.sendCommand(NewDeviceRegisteredCommand(msg.Token()))
 
 	case *events.ContainerMessage:
 		msg, _ := incoming.(*events.ContainerMessage)
@@ -101,10 +156,10 @@ func (w *GovernanceWorker) NewEvent(incoming events.Message) {
 			glog.Infof("Begun execution of containers according to agreement %v", msg.AgreementId)
 
 			cmd := w.NewStartGovernExecutionCommand(msg.Deployment, msg.AgreementProtocol, msg.AgreementId)
-			w.Commands <- cmd
+			w.sendCommand(cmd)
 		case events.EXECUTION_FAILED:
 			cmd := w.NewCleanupExecutionCommand(msg.AgreementProtocol, msg.AgreementId, CANCEL_CONTAINER_FAILURE, msg.Deployment)
-			w.Commands <- cmd
+			w.sendCommand(cmd)
 		}
 
 	case *events.TorrentMessage:
@@ -112,21 +167,21 @@ func (w *GovernanceWorker) NewEvent(incoming events.Message) {
 		switch msg.Event().Id {
 		case events.TORRENT_FAILURE:
 			cmd := w.NewCleanupExecutionCommand(msg.AgreementLaunchContext.AgreementProtocol, msg.AgreementLaunchContext.AgreementId, CANCEL_TORRENT_FAILURE, nil)
-			w.Commands <- cmd
+			w.sendCommand(cmd)
 		}
 	case *events.InitAgreementCancelationMessage:
 		msg, _ := incoming.(*events.InitAgreementCancelationMessage)
 		switch msg.Event().Id {
 		case events.AGREEMENT_ENDED:
 			cmd := w.NewCleanupExecutionCommand(msg.AgreementProtocol, msg.AgreementId, CANCEL_USER_REQUESTED, msg.Deployment)
-			w.Commands <- cmd
+			w.sendCommand(cmd)
 		}
 	case *events.ApiAgreementCancelationMessage:
 		msg, _ := incoming.(*events.ApiAgreementCancelationMessage)
 		switch msg.Event().Id {
 		case events.AGREEMENT_ENDED:
 			cmd := w.NewCleanupExecutionCommand(msg.AgreementProtocol, msg.AgreementId, CANCEL_USER_REQUESTED, msg.Deployment)
-			w.Commands <- cmd
+			w.sendCommand(cmd)
 		}
 	case *events.AccountFundedMessage:
 		msg, _ := incoming.(*events.AccountFundedMessage)
@@ -154,93 +209,211 @@ func (w *GovernanceWorker) governAgreements() {
 		w.bc = bc
 	}
 
+	// Try to keep finalization event-driven: subscribe to AgreementRecorded/AgreementTerminated logs
+	// emitted by the Agreements contract and turn matches into commands on w.Commands. The polling
+	// loop below still runs unconditionally, so if the subscription never comes up (or drops) nothing
+	// but latency is lost, and a full sweep is requested as soon as a subscription is (re)established
+	// so no event is missed while the socket was down.
+	//
+	// ethblockchain.SubscribeLogs/DecodeAgreementEvent don't have a real eth_subscribe implementation
+	// yet (see their doc comments), so until that lands this is gated off by default - starting the
+	// watcher against those stubs would just busy-loop its retry wait forever for no benefit. The
+	// polling loop is the only governance path in practice until EnableAgreementEventSubscription is on.
+	if w.Worker.Manager.Config.Edge.EnableAgreementEventSubscription {
+		watcher := newAgreementEventWatcher(w.Worker.Manager.Config.Edge.GethURL, w.bc.Agreements)
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			watcher.start(w.ctx, w.Commands)
+		}()
+	}
+
 	// go govern
+	w.wg.Add(1)
+	w.msgSendersWg.Add(1)
 	go func() {
-
-		protocolHandler := citizenscientist.NewProtocolHandler(w.Config.Edge.GethURL, w.pm)
+		defer w.wg.Done()
+		defer w.msgSendersWg.Done()
 
 		for {
 			glog.V(4).Infof(logString(fmt.Sprintf("governing pending agreements")))
 
-			// Create a new filter for unfinalized agreements
-			notYetFinalFilter := func() persistence.EAFilter {
-				return func(a persistence.EstablishedAgreement) bool {
-					return a.AgreementCreationTime != 0 && a.AgreementAcceptedTime != 0 && a.AgreementTerminatedTime == 0 && a.CounterPartyAddress != ""
-				}
+			w.sweepAgreements()
+			w.refreshAgreementStateGauges()
+
+			select {
+			case <-w.ctx.Done():
+				return
+			case <-time.After(10 * time.Second):
 			}
+		}
+	}()
+}
+
+// sweepAgreements walks every unarchived, accepted agreement for every registered agreement protocol
+// and checks it for finalization or cancellation. It is the body of the polling loop in
+// governAgreements, and is also invoked directly on a ReconcileAgreementsCommand so that reconnecting
+// the event subscription catches up immediately instead of waiting for the next 10 second tick.
+func (w *GovernanceWorker) sweepAgreements() {
+	for protocolName, protocolHandler := range w.protocolHandlers {
+		w.sweepAgreementsForProtocol(protocolName, protocolHandler)
+	}
+}
+
+func (w *GovernanceWorker) sweepAgreementsForProtocol(protocolName string, protocolHandler ProtocolHandler) {
+	// Create a new filter for unfinalized agreements
+	notYetFinalFilter := func() persistence.EAFilter {
+		return func(a persistence.EstablishedAgreement) bool {
+			return a.AgreementCreationTime != 0 && a.AgreementAcceptedTime != 0 && a.AgreementTerminatedTime == 0 && a.CounterPartyAddress != ""
+		}
+	}
+
+	if establishedAgreements, err := persistence.FindEstablishedAgreements(w.db, protocolName, []persistence.EAFilter{persistence.UnarchivedEAFilter(), notYetFinalFilter()}); err != nil {
+		glog.Errorf(logString(fmt.Sprintf("Unable to retrieve not yet final agreements from database: %v. Error: %v", err, err)))
+	} else {
 
-			if establishedAgreements, err := persistence.FindEstablishedAgreements(w.db, citizenscientist.PROTOCOL_NAME, []persistence.EAFilter{persistence.UnarchivedEAFilter(),notYetFinalFilter()}); err != nil {
-				glog.Errorf(logString(fmt.Sprintf("Unable to retrieve not yet final agreements from database: %v. Error: %v", err, err)))
+		// If there are agreemens in the database then we will assume that the device is already registered
+		for _, ag := range establishedAgreements {
+			if ag.AgreementFinalizedTime == 0 {
+				// Verify that the blockchain update has occurred. If not, roll back a pending
+				// confirmation, or cancel the agreement once it has timed out.
+				glog.V(5).Infof(logString(fmt.Sprintf("checking agreement %v for finalization.", ag.CurrentAgreementId)))
+				if recorded, err := w.verifyAgreementRecorded(protocolHandler, ag.CurrentAgreementId, ag.CounterPartyAddress, ag.ProposalSig, w.bc.Agreements); err != nil {
+					glog.Errorf(logString(fmt.Sprintf("unable to verify agreement %v on blockchain, error: %v", ag.CurrentAgreementId, err)))
+				} else if recorded {
+					w.markRecordedAndMaybeFinalize(ag, protocolHandler, 0)
+				} else if ag.AgreementRecordedBlockNumber != 0 {
+					// We had previously observed this agreement recorded on-chain but it disappeared
+					// again before reaching AgreementConfirmationDepth confirmations - most likely a
+					// short reorg. Roll back the pending state rather than cancelling the agreement
+					// outright; if it gets recorded again we'll start counting confirmations over.
+					glog.Warningf(logString(fmt.Sprintf("agreement %v no longer recorded on blockchain before reaching confirmation depth, rolling back pending finalization", ag.CurrentAgreementId)))
+					if _, err := persistence.SetAgreementRecordedBlock(w.db, ag.CurrentAgreementId, protocolName, 0); err != nil {
+						glog.Errorf(logString(fmt.Sprintf("error rolling back pending block confirmation for agreement %v: %v", ag.CurrentAgreementId, err)))
+					}
+				} else {
+					glog.V(5).Infof(logString(fmt.Sprintf("detected agreement %v not yet final.", ag.CurrentAgreementId)))
+					now := uint64(time.Now().Unix())
+					if ag.AgreementCreationTime+w.Worker.Manager.Config.Edge.AgreementTimeoutS < now {
+						// Start timing out the agreement
+						glog.V(3).Infof(logString(fmt.Sprintf("detected agreement %v timed out.", ag.CurrentAgreementId)))
+
+						w.cancelAgreement(ag.CurrentAgreementId, ag.AgreementProtocol, CANCEL_NOT_FINALIZED_TIMEOUT)
+
+						// cleanup workloads
+						w.Messages() <- events.NewGovernanceCancelationMessage(events.AGREEMENT_ENDED, events.AG_TERMINATED, ag.AgreementProtocol, ag.CurrentAgreementId, ag.CurrentDeployment)
+					}
+				}
 			} else {
 
-				// If there are agreemens in the database then we will assume that the device is already registered
-				for _, ag := range establishedAgreements {
-					if ag.AgreementFinalizedTime == 0 {
-						// Verify that the blockchain update has occurred. If not, cancel the agreement.
-						glog.V(5).Infof(logString(fmt.Sprintf("checking agreement %v for finalization.", ag.CurrentAgreementId)))
-						if recorded, err := protocolHandler.VerifyAgreementRecorded(ag.CurrentAgreementId, ag.CounterPartyAddress, ag.ProposalSig, w.bc.Agreements); err != nil {
-							glog.Errorf(logString(fmt.Sprintf("unable to verify agreement %v on blockchain, error: %v", ag.CurrentAgreementId, err)))
-						} else if recorded {
-							// Update state in the database
-							if _, err := persistence.AgreementStateFinalized(w.db, ag.CurrentAgreementId, citizenscientist.PROTOCOL_NAME); err != nil {
-								glog.Errorf(logString(fmt.Sprintf("error persisting agreement %v finalized: %v", ag.CurrentAgreementId, err)))
-							}
-							// Update state in exchange
-							if proposal, err := protocolHandler.DemarshalProposal(ag.Proposal); err != nil {
-								glog.Errorf(logString(fmt.Sprintf("could not hydrate proposal, error: %v", err)))
-							} else if tcPolicy, err := policy.DemarshalPolicy(proposal.TsAndCs); err != nil {
-								glog.Errorf(logString(fmt.Sprintf("error demarshalling TsAndCs policy for agreement %v, error %v", ag.CurrentAgreementId, err)))
-							} else if err := recordProducerAgreementState(w.Config.Edge.ExchangeURL, w.deviceId, w.deviceToken, ag.CurrentAgreementId, tcPolicy.APISpecs[0].SpecRef, "Finalized Agreement"); err != nil {
-								glog.Errorf(logString(fmt.Sprintf("error setting agreement %v finalized state in exchange: %v", ag.CurrentAgreementId, err)))
-							}
-
-						} else {
-							glog.V(5).Infof(logString(fmt.Sprintf("detected agreement %v not yet final.", ag.CurrentAgreementId)))
-							now := uint64(time.Now().Unix())
-							if ag.AgreementCreationTime+w.Worker.Manager.Config.Edge.AgreementTimeoutS < now {
-								// Start timing out the agreement
-								glog.V(3).Infof(logString(fmt.Sprintf("detected agreement %v timed out.", ag.CurrentAgreementId)))
-
-								w.cancelAgreement(ag.CurrentAgreementId, ag.AgreementProtocol, CANCEL_NOT_FINALIZED_TIMEOUT)
-
-								// cleanup workloads
-								w.Messages() <- events.NewGovernanceCancelationMessage(events.AGREEMENT_ENDED, events.AG_TERMINATED, ag.AgreementProtocol, ag.CurrentAgreementId, ag.CurrentDeployment)
-							}
-						}
-					} else {
-
-						// Make sure the agreement is still in the blockchain
-						if recorded, err := protocolHandler.VerifyAgreementRecorded(ag.CurrentAgreementId, ag.CounterPartyAddress, ag.ProposalSig, w.bc.Agreements); err != nil {
-							glog.Errorf(logString(fmt.Sprintf("unable to verify agreement %v on blockchain, error: %v", ag.CurrentAgreementId, err)))
-						} else if !recorded {
-							glog.Infof(logString(fmt.Sprintf("terminating agreement %v because it has been cancelled on the blockchain.", ag.CurrentAgreementId)))
-							w.cancelAgreement(ag.CurrentAgreementId, ag.AgreementProtocol, CANCEL_DISCOVERED)
-							// cleanup workloads if needed
-							w.Messages() <- events.NewGovernanceCancelationMessage(events.AGREEMENT_ENDED, events.AG_TERMINATED, ag.AgreementProtocol, ag.CurrentAgreementId, ag.CurrentDeployment)
-						}
-
-						if ag.AgreementExecutionStartTime == 0 {
-							// workload not started yet and in an agreement ...
-							if (int64(ag.AgreementAcceptedTime) + (MAX_CONTRACT_PRELAUNCH_TIME_M * 60)) < time.Now().Unix() {
-								glog.Infof(logString(fmt.Sprintf("terminating agreement %v because it hasn't been launched in max allowed time. This could be because of a workload failure.", ag.CurrentAgreementId)))
-								w.cancelAgreement(ag.CurrentAgreementId, ag.AgreementProtocol, CANCEL_NOT_EXECUTED_TIMEOUT)
-								// cleanup workloads if needed
-								w.Messages() <- events.NewGovernanceCancelationMessage(events.AGREEMENT_ENDED, events.AG_TERMINATED, ag.AgreementProtocol, ag.CurrentAgreementId, ag.CurrentDeployment)
-							}
-						}
+				// Make sure the agreement is still in the blockchain
+				if recorded, err := w.verifyAgreementRecorded(protocolHandler, ag.CurrentAgreementId, ag.CounterPartyAddress, ag.ProposalSig, w.bc.Agreements); err != nil {
+					glog.Errorf(logString(fmt.Sprintf("unable to verify agreement %v on blockchain, error: %v", ag.CurrentAgreementId, err)))
+				} else if !recorded {
+					glog.Infof(logString(fmt.Sprintf("terminating agreement %v because it has been cancelled on the blockchain.", ag.CurrentAgreementId)))
+					w.cancelAgreement(ag.CurrentAgreementId, ag.AgreementProtocol, CANCEL_DISCOVERED)
+					// cleanup workloads if needed
+					w.Messages() <- events.NewGovernanceCancelationMessage(events.AGREEMENT_ENDED, events.AG_TERMINATED, ag.AgreementProtocol, ag.CurrentAgreementId, ag.CurrentDeployment)
+				}
+
+				if ag.AgreementExecutionStartTime == 0 {
+					// workload not started yet and in an agreement ...
+					if (int64(ag.AgreementAcceptedTime) + (MAX_CONTRACT_PRELAUNCH_TIME_M * 60)) < time.Now().Unix() {
+						glog.Infof(logString(fmt.Sprintf("terminating agreement %v because it hasn't been launched in max allowed time. This could be because of a workload failure.", ag.CurrentAgreementId)))
+						w.cancelAgreement(ag.CurrentAgreementId, ag.AgreementProtocol, CANCEL_NOT_EXECUTED_TIMEOUT)
+						// cleanup workloads if needed
+						w.Messages() <- events.NewGovernanceCancelationMessage(events.AGREEMENT_ENDED, events.AG_TERMINATED, ag.AgreementProtocol, ag.CurrentAgreementId, ag.CurrentDeployment)
 					}
 				}
 			}
+		}
+	}
+}
 
-			time.Sleep(10 * time.Second)
+// markRecordedAndMaybeFinalize records the block number at which an agreement was first observed
+// recorded on-chain, and only finalizes it once AgreementConfirmationDepth further blocks have gone
+// by. This guards against short reorgs: a transaction that recorded the agreement can still disappear
+// a few blocks later, so we don't want to have already reported "Finalized" to the exchange by then.
+// recordedAtBlock is the block the caller already knows the agreement was recorded at - the event
+// watcher has this straight off the AgreementRecorded log it decoded - and is used instead of an extra
+// GetBlockNumber round trip when it's known; pass 0 when it isn't (the polling sweep has no such log to
+// read it from) and the current chain head is used as before.
+func (w *GovernanceWorker) markRecordedAndMaybeFinalize(ag persistence.EstablishedAgreement, protocolHandler ProtocolHandler, recordedAtBlock uint64) {
+	if ag.AgreementRecordedBlockNumber == 0 {
+		seedBlock := recordedAtBlock
+		if seedBlock == 0 {
+			currentBlock, err := ethblockchain.GetBlockNumber(w.Worker.Manager.Config.Edge.GethURL)
+			if err != nil {
+				glog.Errorf(logString(fmt.Sprintf("unable to get current block number to track confirmation depth for agreement %v: %v", ag.CurrentAgreementId, err)))
+				return
+			}
+			seedBlock = currentBlock
 		}
-	}()
+		glog.V(3).Infof(logString(fmt.Sprintf("agreement %v recorded on-chain at block %v, waiting for %v confirmations", ag.CurrentAgreementId, seedBlock, w.Worker.Manager.Config.Edge.AgreementConfirmationDepth)))
+		if updated, err := persistence.SetAgreementRecordedBlock(w.db, ag.CurrentAgreementId, protocolHandler.Name(), seedBlock); err != nil {
+			glog.Errorf(logString(fmt.Sprintf("error persisting recorded block for agreement %v: %v", ag.CurrentAgreementId, err)))
+		} else {
+			ag = *updated
+		}
+	}
+
+	currentBlock, err := ethblockchain.GetBlockNumber(w.Worker.Manager.Config.Edge.GethURL)
+	if err != nil {
+		glog.Errorf(logString(fmt.Sprintf("unable to get current block number to check confirmation depth for agreement %v: %v", ag.CurrentAgreementId, err)))
+		return
+	}
+
+	if currentBlock < ag.AgreementRecordedBlockNumber {
+		// A lagging or stale node (e.g. right after failing over to a different geth endpoint) can
+		// report a head behind what we already recorded. currentBlock-ag.AgreementRecordedBlockNumber
+		// below is unsigned, so without this guard that would wrap to a huge value and finalize the
+		// agreement with zero real confirmations.
+		glog.Warningf(logString(fmt.Sprintf("current block %v is behind agreement %v's recorded block %v, waiting for the node to catch up before counting confirmations", currentBlock, ag.CurrentAgreementId, ag.AgreementRecordedBlockNumber)))
+		return
+	}
+
+	if currentBlock-ag.AgreementRecordedBlockNumber < w.Worker.Manager.Config.Edge.AgreementConfirmationDepth {
+		glog.V(5).Infof(logString(fmt.Sprintf("agreement %v recorded at block %v, only %v confirmations so far", ag.CurrentAgreementId, ag.AgreementRecordedBlockNumber, currentBlock-ag.AgreementRecordedBlockNumber)))
+		return
+	}
+
+	w.finalizeAgreement(ag, protocolHandler)
+}
+
+// finalizeAgreement persists and reports finalization of an agreement that is now known to be
+// recorded on the blockchain with sufficient confirmation depth. It is shared by the polling sweep
+// and the event-driven AgreementRecordedCommand path so both routes to finalization stay in sync.
+func (w *GovernanceWorker) finalizeAgreement(ag persistence.EstablishedAgreement, protocolHandler ProtocolHandler) {
+	// Update state in the database
+	if _, err := persistence.AgreementStateFinalized(w.db, ag.CurrentAgreementId, protocolHandler.Name()); err != nil {
+		glog.Errorf(logString(fmt.Sprintf("error persisting agreement %v finalized: %v", ag.CurrentAgreementId, err)))
+	}
+	if ag.AgreementCreationTime != 0 && ag.AgreementFinalizedTime == 0 {
+		agreementFinalizationSeconds.Observe(float64(uint64(time.Now().Unix()) - ag.AgreementCreationTime))
+	}
+	// Update state in exchange
+	if proposal, err := protocolHandler.DemarshalProposal(ag.Proposal); err != nil {
+		glog.Errorf(logString(fmt.Sprintf("could not hydrate proposal, error: %v", err)))
+	} else if tcPolicy, err := policy.DemarshalPolicy(proposal.TsAndCs()); err != nil {
+		glog.Errorf(logString(fmt.Sprintf("error demarshalling TsAndCs policy for agreement %v, error %v", ag.CurrentAgreementId, err)))
+	} else if err := recordProducerAgreementState(w.ctx, w.Worker.Manager.Config, w.deviceId, w.deviceToken, ag.CurrentAgreementId, tcPolicy.APISpecs[0].SpecRef, "Finalized Agreement"); err != nil {
+		if _, desynced := err.(*ExchangeDesyncError); desynced {
+			glog.Errorf(logString(fmt.Sprintf("exchange appears down, agreement %v is desynced from the exchange, will retry setting finalized state: %v", ag.CurrentAgreementId, err)))
+			w.sendCommand(NewAgreementRecordedCommand(ag.CurrentAgreementId, ag.AgreementRecordedBlockNumber))
+		} else {
+			glog.Errorf(logString(fmt.Sprintf("error setting agreement %v finalized state in exchange: %v", ag.CurrentAgreementId, err)))
+		}
+	}
 }
 
 func (w *GovernanceWorker) governContainers() {
 
 	// go govern
+	w.wg.Add(1)
+	w.msgSendersWg.Add(1)
 	go func() {
+		defer w.wg.Done()
+		defer w.msgSendersWg.Done()
 
 		for {
 			glog.V(4).Infof(logString(fmt.Sprintf("governing containers")))
@@ -252,22 +425,28 @@ func (w *GovernanceWorker) governContainers() {
 				}
 			}
 
-			if establishedAgreements, err := persistence.FindEstablishedAgreements(w.db, citizenscientist.PROTOCOL_NAME, []persistence.EAFilter{persistence.UnarchivedEAFilter(),runningFilter()}); err != nil {
-				glog.Errorf(logString(fmt.Sprintf("Unable to retrieve running agreements from database, error: %v", err)))
-			} else {
+			for protocolName := range w.protocolHandlers {
+				if establishedAgreements, err := persistence.FindEstablishedAgreements(w.db, protocolName, []persistence.EAFilter{persistence.UnarchivedEAFilter(), runningFilter()}); err != nil {
+					glog.Errorf(logString(fmt.Sprintf("Unable to retrieve running agreements from database, error: %v", err)))
+				} else {
 
-				for _, ag := range establishedAgreements {
+					for _, ag := range establishedAgreements {
 
-					// Make sure containers are still running.
-					glog.V(3).Infof(logString(fmt.Sprintf("fire event to ensure containers are still up for agreement %v.", ag.CurrentAgreementId)))
+						// Make sure containers are still running.
+						glog.V(3).Infof(logString(fmt.Sprintf("fire event to ensure containers are still up for agreement %v.", ag.CurrentAgreementId)))
 
-					// current contract, ensure workloads still running
-					w.Messages() <- events.NewGovernanceMaintenanceMessage(events.CONTAINER_MAINTAIN, ag.AgreementProtocol, ag.CurrentAgreementId, ag.CurrentDeployment)
+						// current contract, ensure workloads still running
+						w.Messages() <- events.NewGovernanceMaintenanceMessage(events.CONTAINER_MAINTAIN, ag.AgreementProtocol, ag.CurrentAgreementId, ag.CurrentDeployment)
 
+					}
 				}
 			}
 
-			time.Sleep(1 * time.Minute)
+			select {
+			case <-w.ctx.Done():
+				return
+			case <-time.After(1 * time.Minute):
+			}
 		}
 	}()
 }
@@ -277,7 +456,12 @@ func (w *GovernanceWorker) governContainers() {
 // cancel on the blockchain, therefore this code needs to be prepared to run multiple times for the
 // same agreement id.
 func (w *GovernanceWorker) cancelAgreement(agreementId string, agreementProtocol string, reason uint) {
-	protocolHandler := citizenscientist.NewProtocolHandler(w.Config.Edge.GethURL, w.pm)
+	agreementCancellationsTotal.WithLabelValues(cancelReasonLabel(reason)).Inc()
+
+	protocolHandler, ok := w.protocolHandlers[agreementProtocol]
+	if !ok {
+		glog.Errorf(logString(fmt.Sprintf("no registered protocol handler for %v, cannot cancel agreement %v on the blockchain", agreementProtocol, agreementId)))
+	}
 
 	// Update the database
 	var ag *persistence.EstablishedAgreement
@@ -288,19 +472,24 @@ func (w *GovernanceWorker) cancelAgreement(agreementId string, agreementProtocol
 	}
 
 	// Delete from the exchange
-	if err := deleteProducerAgreement(w.Config.Edge.ExchangeURL, w.deviceId, w.deviceToken, agreementId); err != nil {
-		glog.Errorf(logString(fmt.Sprintf("error deleting agreement %v in exchange: %v", agreementId, err)))
+	if err := deleteProducerAgreement(w.ctx, w.Worker.Manager.Config, w.deviceId, w.deviceToken, agreementId); err != nil {
+		if _, desynced := err.(*ExchangeDesyncError); desynced {
+			glog.Errorf(logString(fmt.Sprintf("exchange appears down, agreement %v is desynced from the exchange, will retry the cancellation: %v", agreementId, err)))
+			w.sendCommand(w.NewCleanupExecutionCommand(agreementProtocol, agreementId, reason, nil))
+		} else {
+			glog.Errorf(logString(fmt.Sprintf("error deleting agreement %v in exchange: %v", agreementId, err)))
+		}
 	}
 
 	// Get the policy we used in the agreement and then cancel on the blockchain
 	glog.V(5).Infof(logString(fmt.Sprintf("terminating agreement %v on blockchain.", agreementId)))
 
-	if ag != nil {
+	if ag != nil && protocolHandler != nil {
 		if proposal, err := protocolHandler.DemarshalProposal(ag.Proposal); err != nil {
 			glog.Errorf(logString(fmt.Sprintf("error demarshalling agreement %v proposal: %v", agreementId, err)))
-		} else if pPolicy, err := policy.DemarshalPolicy(proposal.ProducerPolicy); err != nil {
+		} else if pPolicy, err := policy.DemarshalPolicy(proposal.ProducerPolicy()); err != nil {
 			glog.Errorf(logString(fmt.Sprintf("error demarshalling agreement %v Producer Policy: %v", agreementId, err)))
-		} else if err := protocolHandler.TerminateAgreement(pPolicy, ag.CounterPartyAddress, agreementId, reason, w.bc.Agreements); err != nil {
+		} else if err := w.terminateAgreement(protocolHandler, pPolicy, ag.CounterPartyAddress, agreementId, reason, w.bc.Agreements); err != nil {
 			glog.Errorf(logString(fmt.Sprintf("error terminating agreement %v on the blockchain: %v", agreementId, err)))
 		}
 	}
@@ -312,18 +501,51 @@ func (w *GovernanceWorker) cancelAgreement(agreementId string, agreementProtocol
 	}
 }
 
+// Stop asks every governance goroutine to exit and begins the shutdown sequence. It returns
+// immediately; call Wait to block until shutdown has fully completed.
+func (w *GovernanceWorker) Stop() {
+	w.cancel()
+}
+
+// Wait blocks until every governance goroutine started by start() has exited, w.Commands has been
+// drained and w.Messages() has been closed. w.Commands itself is left open.
+func (w *GovernanceWorker) Wait() {
+	w.wg.Wait()
+}
+
 func (w *GovernanceWorker) start() {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		serveMetrics(w.ctx, w.Worker.Manager.Config.Edge.MetricsBindAddress)
+	}()
+
+	w.wg.Add(1)
 	go func() {
+		defer w.wg.Done()
 
 		// Hold the governance functions until we have blockchain funding. If there are events occurring that
 		// we need to react to, they will queue up on the command queue while we wait here. The agreement worker
 		// should not be blocked by this.
+	waitForFunding:
 		for {
 			if w.bcWritesEnabled == false {
-				time.Sleep(time.Duration(5) * time.Second)
-				glog.V(3).Infof("GovernanceWorker command processor waiting for funding")
+				select {
+				case <-w.ctx.Done():
+					// Stop was called before funding ever arrived. governAgreements/governContainers
+					// haven't started yet, so there's nothing for msgSendersWg to wait on, but the
+					// drain/shutdown sequence still needs to run so w.Commands is drained and
+					// w.Messages() gets closed the same way the command processor's ctx.Done() case
+					// below does - otherwise Wait() returns while w.Messages() is never closed.
+					glog.Infof("GovernanceWorker command processor shutting down while waiting for funding, draining pending commands")
+					w.drainCommands()
+					w.shutdown()
+					return
+				case <-time.After(time.Duration(5) * time.Second):
+					glog.V(3).Infof("GovernanceWorker command processor waiting for funding")
+				}
 			} else {
-				break
+				break waitForFunding
 			}
 		}
 
@@ -331,42 +553,134 @@ func (w *GovernanceWorker) start() {
 		w.governAgreements()
 		w.governContainers()
 
+		// Archived agreements are garbage collected from this same goroutine, between command
+		// iterations, rather than from a free-running goroutine, so its bolt writes don't need their
+		// own separate scheduling loop. finalizeAgreement/cancelAgreement, which write and archive the
+		// very rows this GC purges, still run concurrently from governAgreements' polling goroutine -
+		// see the comment on runArchiveGC for why that's safe anyway.
+		gcInterval := time.Duration(w.Worker.Manager.Config.Edge.ArchivedAgreementGCIntervalS) * time.Second
+		if gcInterval == 0 {
+			gcInterval = defaultArchivedAgreementGCInterval
+		}
+		gcTicker := time.NewTicker(gcInterval)
+		defer gcTicker.Stop()
+
 		// Fire up the command processor
 		for {
 
 			glog.V(4).Infof("GovernanceWorker command processor blocking waiting to receive incoming commands")
 
-			command := <-w.Commands
-			glog.V(2).Infof("GovernanceWorker received command: %v", command)
+			select {
+			case <-w.ctx.Done():
+				// Stop was called. Drain whatever is already queued so that handlers which need to
+				// send on w.Messages() (e.g. CleanupExecutionCommand) get serviced before we close it.
+				// w.Commands itself is never closed: NewEvent is called by producers whose lifetime
+				// isn't tied to this goroutine's, and closing a channel that a producer might still be
+				// sending on races the producer's send. w.sendCommand guards every such send with
+				// w.ctx.Done() instead, so once cancel() has been observed nothing new lands on
+				// w.Commands and the buffered leftovers below are the last drainCommands will ever see.
+				glog.Infof("GovernanceWorker command processor shutting down, draining pending commands")
+				w.drainCommands()
+				w.shutdown()
+				return
+			case <-gcTicker.C:
+				w.runArchiveGC()
+			case command := <-w.Commands:
+				glog.V(2).Infof("GovernanceWorker received command: %v", command)
+				w.handleCommand(command)
+			}
 
-			// TODO: consolidate DB update cases
-			switch command.(type) {
-			case *DeviceRegisteredCommand:
-				cmd, _ := command.(*DeviceRegisteredCommand)
-				w.deviceToken = cmd.Token
+			runtime.Gosched()
+		}
+	}()
+}
 
-			case *StartGovernExecutionCommand:
-				// TODO: update db start time and tc so it can be governed
-				cmd, _ := command.(*StartGovernExecutionCommand)
-				glog.V(3).Infof("Starting governance on resources in agreement: %v", cmd.AgreementId)
+// drainCommands services every command already queued on w.Commands without blocking for more, so
+// that in-flight producers (and any send onto w.Messages() a handler makes along the way) complete
+// instead of deadlocking against a command processor that has already stopped reading.
+func (w *GovernanceWorker) drainCommands() {
+	for {
+		select {
+		case command := <-w.Commands:
+			w.handleCommand(command)
+		default:
+			return
+		}
+	}
+}
 
-				if _, err := persistence.AgreementStateExecutionStarted(w.db, cmd.AgreementId, cmd.AgreementProtocol, &cmd.Deployment); err != nil {
-					glog.Errorf("Failed to update local contract record to start governing Agreement: %v. Error: %v", cmd.AgreementId, err)
-				}
+// shutdown closes w.Messages(), once drainCommands has given every already-queued handler its chance
+// to send on it and msgSendersWg confirms the governAgreements sweep loop and governContainers loop
+// have both returned. Those two goroutines send on w.Messages() unguarded by a select on ctx.Done(),
+// so closing the channel as soon as this goroutine observes ctx.Done() could race a send that's still
+// in flight on either of them and panic with "send on closed channel"; waiting for them to drain and
+// exit first removes that race. w.Commands is intentionally left open; see the comment above the
+// drainCommands call in start() for why closing it from this side would be unsafe.
+func (w *GovernanceWorker) shutdown() {
+	w.msgSendersWg.Wait()
+	close(w.Worker.Manager.Messages)
+}
 
-			case *CleanupExecutionCommand:
-				cmd, _ := command.(*CleanupExecutionCommand)
-				glog.V(3).Infof("Ending the agreement: %v", cmd.AgreementId)
+// handleCommand is the body of the command processor's switch statement, factored out so that both
+// the normal receive loop and the shutdown-time drain path dispatch commands identically.
+func (w *GovernanceWorker) handleCommand(command worker.Command) {
+	// TODO: consolidate DB update cases
+	switch command.(type) {
+	case *DeviceRegisteredCommand:
+		cmd, _ := command.(*DeviceRegisteredCommand)
+		w.deviceToken = cmd.Token
+
+	case *ReconcileAgreementsCommand:
+		glog.V(3).Infof("Reconciling agreements after (re)connecting the agreement event subscription")
+		w.sweepAgreements()
+
+	case *AgreementRecordedCommand:
+		cmd, _ := command.(*AgreementRecordedCommand)
+		glog.V(3).Infof("Handling on-chain AgreementRecorded event for %v at block %v", cmd.AgreementId, cmd.BlockNumber)
+		if ag, err := persistence.FindEstablishedAgreements(w.db, citizenscientist.PROTOCOL_NAME, []persistence.EAFilter{persistence.UnarchivedEAFilter(), persistence.IdEAFilter(cmd.AgreementId)}); err != nil {
+			glog.Errorf("error looking up agreement %v after AgreementRecorded event: %v", cmd.AgreementId, err)
+		} else if handler, ok := w.protocolHandlers[citizenscientist.PROTOCOL_NAME]; ok && len(ag) == 1 {
+			// The blockchain event watcher only understands the citizenscientist protocol's
+			// contracts, so this path only ever applies to agreements under that protocol.
+			if ag[0].AgreementFinalizedTime == 0 {
+				w.markRecordedAndMaybeFinalize(ag[0], handler, cmd.BlockNumber)
+			} else {
+				// Already finalized locally, e.g. re-enqueued by finalizeAgreement after the exchange
+				// update gave up: report the finalized state to the exchange again.
+				w.finalizeAgreement(ag[0], handler)
+			}
+		}
 
-				w.cancelAgreement(cmd.AgreementId, cmd.AgreementProtocol, cmd.Reason)
+	case *AgreementTerminatedCommand:
+		cmd, _ := command.(*AgreementTerminatedCommand)
+		glog.V(3).Infof("Handling on-chain AgreementTerminated event for %v", cmd.AgreementId)
+		if ag, err := persistence.FindEstablishedAgreements(w.db, citizenscientist.PROTOCOL_NAME, []persistence.EAFilter{persistence.UnarchivedEAFilter(), persistence.IdEAFilter(cmd.AgreementId)}); err != nil {
+			glog.Errorf("error looking up agreement %v after AgreementTerminated event: %v", cmd.AgreementId, err)
+		} else if len(ag) == 1 && ag[0].AgreementTerminatedTime == 0 {
+			w.cancelAgreement(ag[0].CurrentAgreementId, ag[0].AgreementProtocol, CANCEL_DISCOVERED)
+			w.Messages() <- events.NewGovernanceCancelationMessage(events.AGREEMENT_ENDED, events.AG_TERMINATED, ag[0].AgreementProtocol, ag[0].CurrentAgreementId, ag[0].CurrentDeployment)
+		}
 
-				// send the event to the container in case it has started the workloads.
-				w.Messages() <- events.NewGovernanceCancelationMessage(events.AGREEMENT_ENDED, events.AG_TERMINATED, cmd.AgreementProtocol, cmd.AgreementId, cmd.Deployment)
-			}
+	case *StartGovernExecutionCommand:
+		// TODO: update db start time and tc so it can be governed
+		cmd, _ := command.(*StartGovernExecutionCommand)
+		glog.V(3).Infof("Starting governance on resources in agreement: %v", cmd.AgreementId)
 
-			runtime.Gosched()
+		if ag, err := persistence.AgreementStateExecutionStarted(w.db, cmd.AgreementId, cmd.AgreementProtocol, &cmd.Deployment); err != nil {
+			glog.Errorf("Failed to update local contract record to start governing Agreement: %v. Error: %v", cmd.AgreementId, err)
+		} else if ag != nil && ag.AgreementAcceptedTime != 0 {
+			agreementExecutionStartSeconds.Observe(float64(uint64(time.Now().Unix()) - ag.AgreementAcceptedTime))
 		}
-	}()
+
+	case *CleanupExecutionCommand:
+		cmd, _ := command.(*CleanupExecutionCommand)
+		glog.V(3).Infof("Ending the agreement: %v", cmd.AgreementId)
+
+		w.cancelAgreement(cmd.AgreementId, cmd.AgreementProtocol, cmd.Reason)
+
+		// send the event to the container in case it has started the workloads.
+		w.Messages() <- events.NewGovernanceCancelationMessage(events.AGREEMENT_ENDED, events.AG_TERMINATED, cmd.AgreementProtocol, cmd.AgreementId, cmd.Deployment)
+	}
 }
 
 // TODO: consolidate below
@@ -410,7 +724,43 @@ func NewDeviceRegisteredCommand(token string) *DeviceRegisteredCommand {
 	}
 }
 
-func recordProducerAgreementState(url string, deviceId string, token string, agreementId string, microservice string, state string) error {
+// ReconcileAgreementsCommand asks the command processor to run a full agreement sweep right away,
+// instead of waiting for the next polling tick. The event watcher issues one of these every time it
+// (re)establishes its subscription, so that events missed while it was disconnected still get picked up.
+type ReconcileAgreementsCommand struct {
+}
+
+func NewReconcileAgreementsCommand() *ReconcileAgreementsCommand {
+	return &ReconcileAgreementsCommand{}
+}
+
+// AgreementRecordedCommand is emitted by the agreement event watcher when it observes an
+// AgreementRecorded log for agreementId, so that finalization doesn't have to wait on the poller.
+type AgreementRecordedCommand struct {
+	AgreementId string
+	BlockNumber uint64
+}
+
+func NewAgreementRecordedCommand(agreementId string, blockNumber uint64) *AgreementRecordedCommand {
+	return &AgreementRecordedCommand{
+		AgreementId: agreementId,
+		BlockNumber: blockNumber,
+	}
+}
+
+// AgreementTerminatedCommand is emitted by the agreement event watcher when it observes an
+// AgreementTerminated log for agreementId.
+type AgreementTerminatedCommand struct {
+	AgreementId string
+}
+
+func NewAgreementTerminatedCommand(agreementId string) *AgreementTerminatedCommand {
+	return &AgreementTerminatedCommand{
+		AgreementId: agreementId,
+	}
+}
+
+func recordProducerAgreementState(ctx context.Context, cfg *config.HorizonConfig, deviceId string, token string, agreementId string, microservice string, state string) error {
 
 	glog.V(5).Infof(logString(fmt.Sprintf("setting agreement %v state to %v", agreementId, state)))
 
@@ -419,44 +769,50 @@ func recordProducerAgreementState(url string, deviceId string, token string, agr
 	as.State = state
 	var resp interface{}
 	resp = new(exchange.PostDeviceResponse)
-	targetURL := url + "devices/" + deviceId + "/agreements/" + agreementId
-	for {
+	targetURL := cfg.Edge.ExchangeURL + "devices/" + deviceId + "/agreements/" + agreementId
+
+	maxAttempts, maxElapsed := exchangeRetryLimits(cfg)
+	err := retryExchangeCall(ctx, fmt.Sprintf("set agreement %v to state %v", agreementId, state), maxAttempts, maxElapsed, func() (bool, error) {
 		if err, tpErr := exchange.InvokeExchange(&http.Client{}, "PUT", targetURL, deviceId, token, &as, &resp); err != nil {
-			glog.Errorf(logString(fmt.Sprintf(err.Error())))
-			return err
+			return false, err
 		} else if tpErr != nil {
-			glog.Warningf(err.Error())
-			time.Sleep(10 * time.Second)
-			continue
-		} else {
-			glog.V(5).Infof(logString(fmt.Sprintf("set agreement %v to state %v", agreementId, state)))
-			return nil
+			return true, tpErr
 		}
-	}
+		return false, nil
+	})
 
+	if err == nil {
+		glog.V(5).Infof(logString(fmt.Sprintf("set agreement %v to state %v", agreementId, state)))
+	} else {
+		glog.Errorf(logString(err.Error()))
+	}
+	return err
 }
 
-func deleteProducerAgreement(url string, deviceId string, token string, agreementId string) error {
+func deleteProducerAgreement(ctx context.Context, cfg *config.HorizonConfig, deviceId string, token string, agreementId string) error {
 
 	glog.V(5).Infof(logString(fmt.Sprintf("deleting agreement %v in exchange", agreementId)))
 
 	var resp interface{}
 	resp = new(exchange.PostDeviceResponse)
-	targetURL := url + "devices/" + deviceId + "/agreements/" + agreementId
-	for {
+	targetURL := cfg.Edge.ExchangeURL + "devices/" + deviceId + "/agreements/" + agreementId
+
+	maxAttempts, maxElapsed := exchangeRetryLimits(cfg)
+	err := retryExchangeCall(ctx, fmt.Sprintf("delete agreement %v", agreementId), maxAttempts, maxElapsed, func() (bool, error) {
 		if err, tpErr := exchange.InvokeExchange(&http.Client{}, "DELETE", targetURL, deviceId, token, nil, &resp); err != nil {
-			glog.Errorf(logString(fmt.Sprintf(err.Error())))
-			return err
+			return false, err
 		} else if tpErr != nil {
-			glog.Warningf(err.Error())
-			time.Sleep(10 * time.Second)
-			continue
-		} else {
-			glog.V(5).Infof(logString(fmt.Sprintf("deleted agreement %v from exchange", agreementId)))
-			return nil
+			return true, tpErr
 		}
-	}
+		return false, nil
+	})
 
+	if err == nil {
+		glog.V(5).Infof(logString(fmt.Sprintf("deleted agreement %v from exchange", agreementId)))
+	} else {
+		glog.Errorf(logString(err.Error()))
+	}
+	return err
 }
 
 var logString = func(v interface{}) string {
@@ -0,0 +1,47 @@
+package governance
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/open-horizon/anax/config"
+	"github.com/open-horizon/anax/events"
+	"github.com/open-horizon/anax/worker"
+)
+
+// TestStopDuringFundingWaitClosesMessages confirms that Stop() called before bcWritesEnabled ever
+// becomes true still runs the drain/shutdown sequence and closes w.Messages(), the same as stopping
+// after governAgreements/governContainers have started. The funding-wait ctx.Done() case used to
+// return directly instead, so Wait() returned cleanly but w.Messages() was never closed.
+func TestStopDuringFundingWaitClosesMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &GovernanceWorker{ctx: ctx, cancel: cancel}
+	w.Worker.Manager.Config = &config.HorizonConfig{}
+	w.Worker.Manager.Messages = make(chan events.Message)
+	w.Worker.Commands = make(chan worker.Command, 10)
+
+	w.start()
+	w.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		w.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Wait() did not return within 2s of Stop() during the funding wait")
+	}
+
+	select {
+	case _, open := <-w.Messages():
+		if open {
+			t.Fatal("expected w.Messages() to be closed, got a value instead")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("w.Messages() was never closed after Stop() during the funding wait")
+	}
+}
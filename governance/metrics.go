@@ -0,0 +1,152 @@
+package governance
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/anax/ethblockchain"
+	"github.com/open-horizon/anax/persistence"
+	"github.com/open-horizon/anax/policy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+// Metrics modeled on the counters/gauges the Wormhole EVM watcher exposes
+// (wormhole_eth_connection_errors_total, wormhole_eth_messages_observed_total, ...), scoped to
+// GovernanceWorker's view of agreement state and blockchain interactions.
+var (
+	agreementsByState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "anax_governance_agreements",
+		Help: "Number of established agreements currently in each state.",
+	}, []string{"state"})
+
+	agreementCancellationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anax_governance_agreement_cancellations_total",
+		Help: "Total agreement cancellations, broken down by cancellation reason.",
+	}, []string{"reason"})
+
+	blockchainCallsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anax_governance_blockchain_calls_total",
+		Help: "Total agreement protocol calls made against the blockchain, broken down by call and outcome.",
+	}, []string{"call", "outcome"})
+
+	agreementFinalizationSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "anax_governance_agreement_finalization_seconds",
+		Help:    "Wall clock time from agreement creation to finalization.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	agreementExecutionStartSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "anax_governance_agreement_execution_start_seconds",
+		Help:    "Wall clock time from agreement acceptance to workload execution start.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// cancelReasonLabel maps a CANCEL_* reason code to the label used on agreementCancellationsTotal.
+func cancelReasonLabel(reason uint) string {
+	switch reason {
+	case CANCEL_NOT_FINALIZED_TIMEOUT:
+		return "not_finalized_timeout"
+	case CANCEL_POLICY_CHANGED:
+		return "policy_changed"
+	case CANCEL_TORRENT_FAILURE:
+		return "torrent_failure"
+	case CANCEL_CONTAINER_FAILURE:
+		return "container_failure"
+	case CANCEL_NOT_EXECUTED_TIMEOUT:
+		return "not_executed_timeout"
+	case CANCEL_USER_REQUESTED:
+		return "user_requested"
+	case CANCEL_DISCOVERED:
+		return "discovered"
+	default:
+		return "unknown"
+	}
+}
+
+// verifyAgreementRecorded delegates to protocolHandler.VerifyAgreementRecorded, recording whether the
+// call succeeded so blockchainCallsTotal reflects the health of the underlying chain.
+func (w *GovernanceWorker) verifyAgreementRecorded(protocolHandler ProtocolHandler, agreementId string, counterPartyAddress string, signature string, agreements *ethblockchain.Agreements) (bool, error) {
+	recorded, err := protocolHandler.VerifyAgreementRecorded(agreementId, counterPartyAddress, signature, agreements)
+	blockchainCallsTotal.WithLabelValues("verify_agreement_recorded", outcomeLabel(err)).Inc()
+	return recorded, err
+}
+
+// terminateAgreement delegates to protocolHandler.TerminateAgreement, recording the outcome.
+func (w *GovernanceWorker) terminateAgreement(protocolHandler ProtocolHandler, pPolicy *policy.Policy, counterPartyAddress string, agreementId string, reason uint, agreements *ethblockchain.Agreements) error {
+	err := protocolHandler.TerminateAgreement(pPolicy, counterPartyAddress, agreementId, reason, agreements)
+	blockchainCallsTotal.WithLabelValues("terminate_agreement", outcomeLabel(err)).Inc()
+	return err
+}
+
+func outcomeLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// refreshAgreementStateGauges recomputes the anax_governance_agreements gauge from a full scan of
+// every registered protocol's unarchived agreements. It's called once per polling tick rather than on
+// every write, since it's a point-in-time snapshot rather than something that needs to be exact
+// between ticks.
+func (w *GovernanceWorker) refreshAgreementStateGauges() {
+	counts := map[string]float64{
+		"proposed":   0,
+		"accepted":   0,
+		"finalized":  0,
+		"executing":  0,
+		"terminated": 0,
+	}
+
+	for protocolName := range w.protocolHandlers {
+		agreements, err := persistence.FindEstablishedAgreements(w.db, protocolName, []persistence.EAFilter{persistence.UnarchivedEAFilter()})
+		if err != nil {
+			glog.Errorf(logString(fmt.Sprintf("unable to refresh agreement state metrics for protocol %v: %v", protocolName, err)))
+			continue
+		}
+		for _, ag := range agreements {
+			switch {
+			case ag.AgreementTerminatedTime != 0:
+				counts["terminated"]++
+			case ag.AgreementExecutionStartTime != 0:
+				counts["executing"]++
+			case ag.AgreementFinalizedTime != 0:
+				counts["finalized"]++
+			case ag.AgreementAcceptedTime != 0:
+				counts["accepted"]++
+			default:
+				counts["proposed"]++
+			}
+		}
+	}
+
+	for state, count := range counts {
+		agreementsByState.WithLabelValues(state).Set(count)
+	}
+}
+
+// serveMetrics exposes the registered governance metrics on bindAddress until ctx is done. It is a
+// no-op when bindAddress is empty, so metrics collection stays opt-in via HorizonConfig.
+func serveMetrics(ctx context.Context, bindAddress string) {
+	if bindAddress == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: bindAddress, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	glog.Infof(logString(fmt.Sprintf("serving governance metrics on %v/metrics", bindAddress)))
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		glog.Errorf(logString(fmt.Sprintf("metrics server exited: %v", err)))
+	}
+}
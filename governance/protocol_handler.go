@@ -0,0 +1,68 @@
+package governance
+
+import (
+	"github.com/open-horizon/anax/citizenscientist"
+	"github.com/open-horizon/anax/ethblockchain"
+	"github.com/open-horizon/anax/policy"
+)
+
+// Proposal is the subset of an agreement proposal that the governor needs, independent of which
+// agreement protocol produced it.
+type Proposal interface {
+	TsAndCs() string
+	ProducerPolicy() string
+}
+
+// ProtocolHandler is the agreement-protocol behavior GovernanceWorker depends on. Implementing this
+// for a new settlement layer (a dbft-style protocol, an off-chain protocol, ...) is all that's needed
+// to plug it into governAgreements/governContainers/cancelAgreement - none of them need to change.
+type ProtocolHandler interface {
+	Name() string
+	VerifyAgreementRecorded(agreementId string, counterPartyAddress string, signature string, agreements *ethblockchain.Agreements) (bool, error)
+	TerminateAgreement(pPolicy *policy.Policy, counterPartyAddress string, agreementId string, reason uint, agreements *ethblockchain.Agreements) error
+	DemarshalProposal(proposal string) (Proposal, error)
+}
+
+// protocolHandlerFactory builds a ProtocolHandler for a registered protocol name. Handlers are cheap
+// to construct (as citizenscientist.NewProtocolHandler already is) so the registry hands back a
+// factory rather than caching a single instance.
+type protocolHandlerFactory func(gethURL string, pm *policy.PolicyManager) ProtocolHandler
+
+var protocolHandlerRegistry = map[string]protocolHandlerFactory{
+	citizenscientist.PROTOCOL_NAME: newCitizenScientistHandler,
+}
+
+// RegisterProtocolHandler makes a new agreement protocol available to GovernanceWorker. It should be
+// called from an init() in the package implementing the protocol.
+func RegisterProtocolHandler(name string, factory protocolHandlerFactory) {
+	protocolHandlerRegistry[name] = factory
+}
+
+// citizenScientistHandler adapts citizenscientist.ProtocolHandler to the governance ProtocolHandler
+// interface.
+type citizenScientistHandler struct {
+	*citizenscientist.ProtocolHandler
+}
+
+func newCitizenScientistHandler(gethURL string, pm *policy.PolicyManager) ProtocolHandler {
+	return &citizenScientistHandler{citizenscientist.NewProtocolHandler(gethURL, pm)}
+}
+
+func (h *citizenScientistHandler) Name() string {
+	return citizenscientist.PROTOCOL_NAME
+}
+
+func (h *citizenScientistHandler) DemarshalProposal(proposal string) (Proposal, error) {
+	p, err := h.ProtocolHandler.DemarshalProposal(proposal)
+	if err != nil {
+		return nil, err
+	}
+	return &citizenScientistProposal{p}, nil
+}
+
+type citizenScientistProposal struct {
+	p *citizenscientist.Proposal
+}
+
+func (p *citizenScientistProposal) TsAndCs() string        { return p.p.TsAndCs }
+func (p *citizenScientistProposal) ProducerPolicy() string { return p.p.ProducerPolicy }
@@ -0,0 +1,30 @@
+package governance
+
+import (
+	"github.com/open-horizon/anax/citizenscientist"
+	"github.com/open-horizon/anax/policy"
+	"testing"
+)
+
+func TestProtocolHandlerRegistryHasCitizenScientistByDefault(t *testing.T) {
+	handler, ok := protocolHandlerRegistry[citizenscientist.PROTOCOL_NAME]
+	if !ok {
+		t.Fatalf("expected %v to be registered by default", citizenscientist.PROTOCOL_NAME)
+	}
+	if got := handler("", nil).Name(); got != citizenscientist.PROTOCOL_NAME {
+		t.Errorf("factory produced a handler named %v, expected %v", got, citizenscientist.PROTOCOL_NAME)
+	}
+}
+
+func TestRegisterProtocolHandlerAddsToRegistry(t *testing.T) {
+	const protocolName = "test-protocol"
+	defer delete(protocolHandlerRegistry, protocolName)
+
+	RegisterProtocolHandler(protocolName, func(gethURL string, pm *policy.PolicyManager) ProtocolHandler {
+		return &citizenScientistHandler{citizenscientist.NewProtocolHandler(gethURL, pm)}
+	})
+
+	if _, ok := protocolHandlerRegistry[protocolName]; !ok {
+		t.Fatalf("expected %v to be registered after RegisterProtocolHandler", protocolName)
+	}
+}
@@ -0,0 +1,144 @@
+package governance
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/anax/config"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Bounds for the exponential backoff used by retryExchangeCall. The per-call max attempts/elapsed
+// time come from HorizonConfig so operators can tune how long a device will tolerate a down exchange.
+const exchangeRetryBaseDelay = 1 * time.Second
+const exchangeRetryMaxDelay = 2 * time.Minute
+
+// Defaults applied when HorizonConfig leaves ExchangeRetryMaxAttempts/ExchangeRetryMaxElapsedS at
+// their zero value. retryExchangeCall treats 0 as "unbounded", so without these an unconfigured
+// device would retry a down exchange forever instead of giving up with an ExchangeDesyncError.
+const defaultExchangeRetryMaxAttempts = 10
+const defaultExchangeRetryMaxElapsed = 10 * time.Minute
+
+// ExchangeDesyncError is returned by retryExchangeCall when it gives up after exhausting its retry
+// budget. Callers should surface the affected agreement as out of sync with the exchange and
+// re-enqueue the work via the command channel rather than retrying inline.
+type ExchangeDesyncError struct {
+	op  string
+	err error
+}
+
+func (e *ExchangeDesyncError) Error() string {
+	return fmt.Sprintf("exchange call (%v) gave up after exhausting retries: %v", e.op, e.err)
+}
+
+// exchangeCircuitBreaker remembers, across every caller, how long to back off after the exchange has
+// been observed down. Without this, every goroutine retrying its own agreement update would hammer
+// the exchange with its own independent backoff schedule as soon as it noticed a problem.
+type exchangeCircuitBreaker struct {
+	mu        sync.Mutex
+	openUntil time.Time
+}
+
+var exchangeBreaker = &exchangeCircuitBreaker{}
+
+// remaining returns how much longer callers should wait before trying the exchange again.
+func (b *exchangeCircuitBreaker) remaining() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func (b *exchangeCircuitBreaker) trip(cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until := time.Now().Add(cooldown); until.After(b.openUntil) {
+		b.openUntil = until
+	}
+}
+
+func (b *exchangeCircuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.openUntil = time.Time{}
+}
+
+// exchangeRetryLimits reads the operator-tunable retry budget off cfg, substituting the package
+// defaults for whichever of ExchangeRetryMaxAttempts/ExchangeRetryMaxElapsedS is left at its zero
+// value, so retryExchangeCall gives up on a down exchange out of the box instead of retrying forever.
+func exchangeRetryLimits(cfg *config.HorizonConfig) (int, time.Duration) {
+	maxAttempts := cfg.Edge.ExchangeRetryMaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = defaultExchangeRetryMaxAttempts
+	}
+
+	maxElapsed := time.Duration(cfg.Edge.ExchangeRetryMaxElapsedS) * time.Second
+	if maxElapsed == 0 {
+		maxElapsed = defaultExchangeRetryMaxElapsed
+	}
+
+	return maxAttempts, maxElapsed
+}
+
+// retryExchangeCall invokes fn with exponential backoff and full jitter between attempts, bounded by
+// maxAttempts (0 means unbounded) and maxElapsed (0 means unbounded). fn reports whether its error is
+// worth retrying: (false, err) is a permanent failure and is returned immediately; (true, err) is a
+// transient failure (e.g. the transport errors recordProducerAgreementState/deleteProducerAgreement
+// used to loop on forever) and triggers another attempt after the backoff delay. Once the exchange is
+// believed to be down, the shared circuit breaker makes every caller wait out the same cooldown
+// instead of retrying independently. ctx is checked between every sleep so that a caller running on a
+// governance goroutine unblocks as soon as Stop() is called, instead of holding Wait() up for as long
+// as a whole backoff/circuit-breaker wait.
+func retryExchangeCall(ctx context.Context, op string, maxAttempts int, maxElapsed time.Duration, fn func() (retryable bool, err error)) error {
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		if wait := exchangeBreaker.remaining(); wait > 0 {
+			glog.V(3).Infof(logString(fmt.Sprintf("exchange circuit breaker open, waiting %v before %v", wait, op)))
+			if err := sleepOrDone(ctx, wait); err != nil {
+				return err
+			}
+		}
+
+		retryable, err := fn()
+		if err == nil {
+			exchangeBreaker.reset()
+			return nil
+		} else if !retryable {
+			return err
+		}
+
+		if (maxAttempts > 0 && attempt+1 >= maxAttempts) || (maxElapsed > 0 && time.Since(start) >= maxElapsed) {
+			delay := backoffWithFullJitter(attempt)
+			exchangeBreaker.trip(delay)
+			return &ExchangeDesyncError{op: op, err: err}
+		}
+
+		delay := backoffWithFullJitter(attempt)
+		exchangeBreaker.trip(delay)
+		glog.Warningf(logString(fmt.Sprintf("%v failed, retrying in %v: %v", op, delay, err)))
+		if err := sleepOrDone(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// sleepOrDone waits out d, or returns ctx's error as soon as ctx is done, whichever comes first.
+func sleepOrDone(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// backoffWithFullJitter implements "full jitter" backoff: sleep = random(0, min(cap, base*2^attempt)).
+func backoffWithFullJitter(attempt int) time.Duration {
+	capped := math.Min(float64(exchangeRetryMaxDelay), float64(exchangeRetryBaseDelay)*math.Pow(2, float64(attempt)))
+	return time.Duration(rand.Float64() * capped)
+}
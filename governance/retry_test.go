@@ -0,0 +1,85 @@
+package governance
+
+import (
+	"context"
+	"errors"
+	"github.com/open-horizon/anax/config"
+	"testing"
+	"time"
+)
+
+func TestBackoffWithFullJitterStaysWithinCap(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		for i := 0; i < 20; i++ {
+			delay := backoffWithFullJitter(attempt)
+			if delay < 0 || delay > exchangeRetryMaxDelay {
+				t.Fatalf("attempt %v: delay %v outside [0, %v]", attempt, delay, exchangeRetryMaxDelay)
+			}
+		}
+	}
+}
+
+func TestExchangeRetryLimitsAppliesDefaults(t *testing.T) {
+	maxAttempts, maxElapsed := exchangeRetryLimits(&config.HorizonConfig{})
+	if maxAttempts != defaultExchangeRetryMaxAttempts {
+		t.Errorf("maxAttempts = %v, expected default %v", maxAttempts, defaultExchangeRetryMaxAttempts)
+	}
+	if maxElapsed != defaultExchangeRetryMaxElapsed {
+		t.Errorf("maxElapsed = %v, expected default %v", maxElapsed, defaultExchangeRetryMaxElapsed)
+	}
+}
+
+func TestExchangeRetryLimitsHonorsConfiguredValues(t *testing.T) {
+	cfg := &config.HorizonConfig{}
+	cfg.Edge.ExchangeRetryMaxAttempts = 3
+	cfg.Edge.ExchangeRetryMaxElapsedS = 30
+
+	maxAttempts, maxElapsed := exchangeRetryLimits(cfg)
+	if maxAttempts != 3 {
+		t.Errorf("maxAttempts = %v, expected 3", maxAttempts)
+	}
+	if maxElapsed != 30*time.Second {
+		t.Errorf("maxElapsed = %v, expected 30s", maxElapsed)
+	}
+}
+
+// TestRetryExchangeCallGivesUpAtMaxAttempts confirms retryExchangeCall stops retrying once maxAttempts
+// is exhausted instead of retrying forever, which is exactly the behavior exchangeRetryLimits' defaults
+// exist to guarantee out of the box.
+func TestRetryExchangeCallGivesUpAtMaxAttempts(t *testing.T) {
+	exchangeBreaker.reset()
+	defer exchangeBreaker.reset()
+
+	attempts := 0
+	err := retryExchangeCall(context.Background(), "test call", 1, 0, func() (bool, error) {
+		attempts++
+		return true, errors.New("exchange unreachable")
+	})
+
+	if attempts != 1 {
+		t.Fatalf("expected exactly 1 attempt before giving up, got %v", attempts)
+	}
+
+	var desyncErr *ExchangeDesyncError
+	if !errors.As(err, &desyncErr) {
+		t.Fatalf("expected an ExchangeDesyncError, got %v", err)
+	}
+}
+
+func TestRetryExchangeCallSucceedsWithoutExhaustingAttempts(t *testing.T) {
+	exchangeBreaker.reset()
+	defer exchangeBreaker.reset()
+
+	attempts := 0
+	err := retryExchangeCall(context.Background(), "test call", 5, 0, func() (bool, error) {
+		attempts++
+		return false, nil
+	})
+
+	if err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected exactly 1 attempt on immediate success, got %v", attempts)
+	}
+}
@@ -0,0 +1,193 @@
+// Package persistence is the bolt-backed local store for device state: established agreements,
+// exchange registration, and anything else GovernanceWorker and its peers need to survive a restart.
+package persistence
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+)
+
+// ServiceConfig is the deployment-time configuration for one workload in an agreement.
+type ServiceConfig struct {
+	Config map[string]string
+}
+
+// EstablishedAgreement is the local record of one agreement this device has made with a counterparty,
+// from proposal through finalization, execution, and eventual termination/archival.
+type EstablishedAgreement struct {
+	CurrentAgreementId           string
+	AgreementProtocol            string
+	Proposal                     string
+	ProposalSig                  string
+	CounterPartyAddress          string
+	CurrentDeployment            map[string]ServiceConfig
+	AgreementCreationTime        uint64
+	AgreementAcceptedTime        uint64
+	AgreementRecordedBlockNumber uint64
+	AgreementFinalizedTime       uint64
+	AgreementExecutionStartTime  uint64
+	AgreementTerminatedTime      uint64
+	Archived                     bool
+	ArchivedTime                 uint64
+}
+
+// EAFilter narrows a FindEstablishedAgreements scan to the records callers care about.
+type EAFilter func(EstablishedAgreement) bool
+
+// UnarchivedEAFilter excludes agreements that have already been archived.
+func UnarchivedEAFilter() EAFilter {
+	return func(a EstablishedAgreement) bool {
+		return !a.Archived
+	}
+}
+
+// IdEAFilter narrows a scan down to a single agreement id, for the agreement event watcher's lookups.
+func IdEAFilter(agreementId string) EAFilter {
+	return func(a EstablishedAgreement) bool {
+		return a.CurrentAgreementId == agreementId
+	}
+}
+
+func agreementBucket(protocolName string) []byte {
+	return []byte(fmt.Sprintf("established_agreements_%v", protocolName))
+}
+
+// FindEstablishedAgreements returns every agreement under protocolName that matches every filter.
+func FindEstablishedAgreements(db *bolt.DB, protocolName string, filters []EAFilter) ([]EstablishedAgreement, error) {
+	var matches []EstablishedAgreement
+
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(agreementBucket(protocolName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, v []byte) error {
+			var ag EstablishedAgreement
+			if err := json.Unmarshal(v, &ag); err != nil {
+				return err
+			}
+			for _, filter := range filters {
+				if !filter(ag) {
+					return nil
+				}
+			}
+			matches = append(matches, ag)
+			return nil
+		})
+	})
+
+	return matches, err
+}
+
+// updateEstablishedAgreement reads the agreement, applies mutate, persists it back, and returns the
+// updated record. It's the shared body of every EstablishedAgreement state transition below.
+func updateEstablishedAgreement(db *bolt.DB, agreementId string, protocolName string, mutate func(*EstablishedAgreement)) (*EstablishedAgreement, error) {
+	var updated EstablishedAgreement
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(agreementBucket(protocolName))
+		if err != nil {
+			return err
+		}
+
+		raw := bucket.Get([]byte(agreementId))
+		if raw == nil {
+			return fmt.Errorf("no established agreement %v under protocol %v", agreementId, protocolName)
+		}
+
+		if err := json.Unmarshal(raw, &updated); err != nil {
+			return err
+		}
+
+		mutate(&updated)
+
+		serialized, err := json.Marshal(updated)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(agreementId), serialized)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &updated, nil
+}
+
+// SetAgreementRecordedBlock records the block number agreementId was observed recorded at on the
+// blockchain, so markRecordedAndMaybeFinalize can count confirmations against it on subsequent calls.
+// Passing 0 clears it, which is how a short reorg rollback is expressed.
+func SetAgreementRecordedBlock(db *bolt.DB, agreementId string, protocolName string, blockNumber uint64) (*EstablishedAgreement, error) {
+	return updateEstablishedAgreement(db, agreementId, protocolName, func(ag *EstablishedAgreement) {
+		ag.AgreementRecordedBlockNumber = blockNumber
+	})
+}
+
+// AgreementStateFinalized marks agreementId finalized.
+func AgreementStateFinalized(db *bolt.DB, agreementId string, protocolName string) (*EstablishedAgreement, error) {
+	return updateEstablishedAgreement(db, agreementId, protocolName, func(ag *EstablishedAgreement) {
+		if ag.AgreementFinalizedTime == 0 {
+			ag.AgreementFinalizedTime = nowUnix()
+		}
+	})
+}
+
+// AgreementStateTerminated marks agreementId terminated.
+func AgreementStateTerminated(db *bolt.DB, agreementId string, protocolName string) (*EstablishedAgreement, error) {
+	return updateEstablishedAgreement(db, agreementId, protocolName, func(ag *EstablishedAgreement) {
+		if ag.AgreementTerminatedTime == 0 {
+			ag.AgreementTerminatedTime = nowUnix()
+		}
+	})
+}
+
+// AgreementStateExecutionStarted marks agreementId's workload execution started and records the
+// deployment description it started with.
+func AgreementStateExecutionStarted(db *bolt.DB, agreementId string, protocolName string, deployment *map[string]ServiceConfig) (*EstablishedAgreement, error) {
+	return updateEstablishedAgreement(db, agreementId, protocolName, func(ag *EstablishedAgreement) {
+		if ag.AgreementExecutionStartTime == 0 {
+			ag.AgreementExecutionStartTime = nowUnix()
+		}
+		if deployment != nil {
+			ag.CurrentDeployment = *deployment
+		}
+	})
+}
+
+// ArchiveEstablishedAgreement marks agreementId archived so it drops out of UnarchivedEAFilter scans
+// and becomes eligible for retention-based garbage collection.
+func ArchiveEstablishedAgreement(db *bolt.DB, agreementId string, protocolName string) (*EstablishedAgreement, error) {
+	return updateEstablishedAgreement(db, agreementId, protocolName, func(ag *EstablishedAgreement) {
+		ag.Archived = true
+		ag.ArchivedTime = nowUnix()
+	})
+}
+
+// ExchangeDevice is this device's local record of its exchange registration.
+type ExchangeDevice struct {
+	Token string
+}
+
+var exchangeDeviceBucket = []byte("exchange_device")
+var exchangeDeviceKey = []byte("self")
+
+// FindExchangeDevice returns this device's exchange registration, or nil if it hasn't registered yet.
+func FindExchangeDevice(db *bolt.DB) (*ExchangeDevice, error) {
+	var dev *ExchangeDevice
+
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(exchangeDeviceBucket)
+		if bucket == nil {
+			return nil
+		}
+		raw := bucket.Get(exchangeDeviceKey)
+		if raw == nil {
+			return nil
+		}
+		dev = &ExchangeDevice{}
+		return json.Unmarshal(raw, dev)
+	})
+
+	return dev, err
+}
@@ -0,0 +1,51 @@
+package persistence
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+)
+
+// PurgeArchivedAgreementsOlderThan deletes every archived agreement under protocolName whose
+// ArchivedTime is before cutoff, and returns how many rows were removed. Agreements that haven't been
+// archived yet are never touched, regardless of age.
+func PurgeArchivedAgreementsOlderThan(db *bolt.DB, protocolName string, cutoff uint64) (int, error) {
+	var reclaimed int
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(agreementBucket(protocolName))
+		if bucket == nil {
+			return nil
+		}
+
+		var staleKeys [][]byte
+		if err := bucket.ForEach(func(k, v []byte) error {
+			var ag EstablishedAgreement
+			if err := json.Unmarshal(v, &ag); err != nil {
+				return err
+			}
+			if ag.Archived && ag.ArchivedTime != 0 && ag.ArchivedTime < cutoff {
+				staleKeys = append(staleKeys, append([]byte(nil), k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range staleKeys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+			reclaimed++
+		}
+		return nil
+	})
+
+	return reclaimed, err
+}
+
+// CompactArchivedAgreements is called after a purge. It only syncs the database file to disk
+// (db.Sync); it does not defragment or shrink the file. bolt reuses the pages the deletes freed on
+// subsequent writes on its own.
+func CompactArchivedAgreements(db *bolt.DB) error {
+	return db.Sync()
+}
@@ -0,0 +1,9 @@
+package persistence
+
+import "time"
+
+// nowUnix is the single place state-transition helpers in this package get the current time from, so
+// the timestamp semantics of AgreementStateFinalized/AgreementStateTerminated/etc. stay consistent.
+func nowUnix() uint64 {
+	return uint64(time.Now().Unix())
+}